@@ -0,0 +1,326 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bridgeautopilot implements the BridgeAutopilotReconciler, which
+// watches Synapse objects and materializes Heisenbridge / MautrixSignal
+// CRs on the user's behalf when they're declared inline under
+// Synapse.Spec.Bridges with AutoProvision set. This spares users from
+// having to kubectl apply each bridge CR by hand, and from wiring
+// NeedsReconcile themselves once their dependencies become available.
+package bridgeautopilot
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/opdev/subreconciler"
+	synapsev1alpha1 "github.com/opdev/synapse-operator/apis/synapse/v1alpha1"
+	"github.com/opdev/synapse-operator/helpers/utils"
+)
+
+// BridgeAutopilotReconciler reconciles a Synapse object, stamping out
+// bridge CRs declared under its Spec.Bridges once their dependencies are
+// satisfied.
+type BridgeAutopilotReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// HeisenbridgeBlockedCondition and MautrixSignalBlockedCondition are the
+// condition types set on Synapse.Status when the corresponding
+// auto-provisioned bridge is held back because one of its dependencies is
+// missing. They're kept distinct so that one bridge being blocked never
+// hides the other's status, since reconcileHeisenbridgeAutopilot and
+// reconcileMautrixSignalAutopilot each halt the subreconciler loop on
+// their own block.
+const (
+	HeisenbridgeBlockedCondition  = "HeisenbridgeBlocked"
+	MautrixSignalBlockedCondition = "MautrixSignalBlocked"
+)
+
+//+kubebuilder:rbac:groups=synapse.opdev.io,resources=synapses,verbs=get;list;watch
+//+kubebuilder:rbac:groups=synapse.opdev.io,resources=synapses/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=synapse.opdev.io,resources=heisenbridges,verbs=get;list;watch;create
+//+kubebuilder:rbac:groups=synapse.opdev.io,resources=mautrixsignals,verbs=get;list;watch;create
+
+// Reconcile is part of the main kubernetes reconciliation loop. It
+// inspects a Synapse's declared bridges and, for each one flagged
+// AutoProvision, either creates the corresponding bridge CR or records
+// why it can't yet.
+func (r *BridgeAutopilotReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var s synapsev1alpha1.Synapse
+	if r, err := r.getLatestSynapse(ctx, req, &s); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return subreconciler.Evaluate(r, err)
+	}
+
+	subreconcilersForBridgeAutopilot := []subreconciler.FnWithRequest{
+		r.reconcileHeisenbridgeAutopilot,
+		r.reconcileMautrixSignalAutopilot,
+	}
+
+	for _, f := range subreconcilersForBridgeAutopilot {
+		if r, err := f(ctx, req); subreconciler.ShouldHaltOrRequeue(r, err) {
+			return subreconciler.Evaluate(r, err)
+		}
+	}
+
+	return subreconciler.Evaluate(subreconciler.DoNotRequeue())
+}
+
+func (r *BridgeAutopilotReconciler) getLatestSynapse(
+	ctx context.Context,
+	req ctrl.Request,
+	s *synapsev1alpha1.Synapse,
+) (*ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+
+	if err := r.Get(ctx, req.NamespacedName, s); err != nil {
+		if k8serrors.IsNotFound(err) {
+			log.Error(err, "Cannot find Synapse - has it been deleted ?", "Synapse Name", s.Name, "Synapse Namespace", s.Namespace)
+			return subreconciler.DoNotRequeue()
+		}
+		log.Error(err, "Error fetching Synapse", "Synapse Name", s.Name, "Synapse Namespace", s.Namespace)
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
+
+// reconcileHeisenbridgeAutopilot is a function of type FnWithRequest, to
+// be called in the main reconciliation loop.
+//
+// If Spec.Bridges.Heisenbridge.AutoProvision is set, it creates a draft
+// Heisenbridge CR once every dependency it lists is satisfied, or reports
+// the missing one via the HeisenbridgeBlocked condition otherwise.
+func (r *BridgeAutopilotReconciler) reconcileHeisenbridgeAutopilot(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	s := &synapsev1alpha1.Synapse{}
+	if r, err := r.getLatestSynapse(ctx, req, s); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	hb := s.Spec.Bridges.Heisenbridge
+	if hb == nil || !hb.AutoProvision {
+		return subreconciler.ContinueReconciling()
+	}
+
+	existing := &synapsev1alpha1.Heisenbridge{}
+	err := r.Get(ctx, types.NamespacedName{Name: s.Name + "-heisenbridge", Namespace: s.Namespace}, existing)
+	if err == nil {
+		// Already provisioned; nothing left for the autopilot to do.
+		if err := r.unblockBridge(ctx, s, HeisenbridgeBlockedCondition); err != nil {
+			return subreconciler.RequeueWithError(err)
+		}
+		return subreconciler.ContinueReconciling()
+	}
+	if !k8serrors.IsNotFound(err) {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if hb.ConfigMap.Name != "" {
+		if missing, err := r.isConfigMapMissing(ctx, hb.ConfigMap.Name, s.Namespace); err != nil {
+			return subreconciler.RequeueWithError(err)
+		} else if missing {
+			return r.blockBridge(ctx, s, HeisenbridgeBlockedCondition, fmt.Sprintf("ConfigMap %s referenced by Spec.Bridges.Heisenbridge.ConfigMap not found", hb.ConfigMap.Name))
+		}
+	}
+
+	if hb.MediaStorePVC.Name != "" {
+		if missing, err := r.isPVCMissing(ctx, hb.MediaStorePVC.Name, s.Namespace); err != nil {
+			return subreconciler.RequeueWithError(err)
+		} else if missing {
+			return r.blockBridge(ctx, s, HeisenbridgeBlockedCondition, fmt.Sprintf("PVC %s referenced by Spec.Bridges.Heisenbridge.MediaStorePVC not found", hb.MediaStorePVC.Name))
+		}
+	}
+
+	draft := &synapsev1alpha1.Heisenbridge{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.Name + "-heisenbridge",
+			Namespace: s.Namespace,
+		},
+		Spec: synapsev1alpha1.HeisenbridgeSpec{
+			Synapse:       synapsev1alpha1.NamespacedName{Name: s.Name, Namespace: s.Namespace},
+			ConfigMap:     hb.ConfigMap,
+			MediaStorePVC: hb.MediaStorePVC,
+		},
+	}
+
+	if err := ctrl.SetControllerReference(s, draft, r.Scheme); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if err := r.Create(ctx, draft); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if err := r.unblockBridge(ctx, s, HeisenbridgeBlockedCondition); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
+
+// reconcileMautrixSignalAutopilot is a function of type FnWithRequest, to
+// be called in the main reconciliation loop.
+//
+// If Spec.Bridges.MautrixSignal.AutoProvision is set, it creates a draft
+// MautrixSignal CR once every dependency it lists is satisfied, or reports
+// the missing one via the MautrixSignalBlocked condition otherwise.
+func (r *BridgeAutopilotReconciler) reconcileMautrixSignalAutopilot(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	s := &synapsev1alpha1.Synapse{}
+	if r, err := r.getLatestSynapse(ctx, req, s); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	ms := s.Spec.Bridges.MautrixSignal
+	if ms == nil || !ms.AutoProvision {
+		return subreconciler.ContinueReconciling()
+	}
+
+	existing := &synapsev1alpha1.MautrixSignal{}
+	err := r.Get(ctx, types.NamespacedName{Name: s.Name + "-mautrixsignal", Namespace: s.Namespace}, existing)
+	if err == nil {
+		if err := r.unblockBridge(ctx, s, MautrixSignalBlockedCondition); err != nil {
+			return subreconciler.RequeueWithError(err)
+		}
+		return subreconciler.ContinueReconciling()
+	}
+	if !k8serrors.IsNotFound(err) {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if ms.ConfigMap.Name != "" {
+		if missing, err := r.isConfigMapMissing(ctx, ms.ConfigMap.Name, s.Namespace); err != nil {
+			return subreconciler.RequeueWithError(err)
+		} else if missing {
+			return r.blockBridge(ctx, s, MautrixSignalBlockedCondition, fmt.Sprintf("ConfigMap %s referenced by Spec.Bridges.MautrixSignal.ConfigMap not found", ms.ConfigMap.Name))
+		}
+	}
+
+	if ms.MediaStorePVC.Name != "" {
+		if missing, err := r.isPVCMissing(ctx, ms.MediaStorePVC.Name, s.Namespace); err != nil {
+			return subreconciler.RequeueWithError(err)
+		} else if missing {
+			return r.blockBridge(ctx, s, MautrixSignalBlockedCondition, fmt.Sprintf("PVC %s referenced by Spec.Bridges.MautrixSignal.MediaStorePVC not found", ms.MediaStorePVC.Name))
+		}
+	}
+
+	if ms.SignaldPVC.Name != "" {
+		if missing, err := r.isPVCMissing(ctx, ms.SignaldPVC.Name, s.Namespace); err != nil {
+			return subreconciler.RequeueWithError(err)
+		} else if missing {
+			return r.blockBridge(ctx, s, MautrixSignalBlockedCondition, fmt.Sprintf("PVC %s referenced by Spec.Bridges.MautrixSignal.SignaldPVC not found", ms.SignaldPVC.Name))
+		}
+	}
+
+	draft := &synapsev1alpha1.MautrixSignal{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.Name + "-mautrixsignal",
+			Namespace: s.Namespace,
+		},
+		Spec: synapsev1alpha1.MautrixSignalSpec{
+			Synapse:       synapsev1alpha1.NamespacedName{Name: s.Name, Namespace: s.Namespace},
+			ConfigMap:     ms.ConfigMap,
+			MediaStorePVC: ms.MediaStorePVC,
+			SignaldPVC:    ms.SignaldPVC,
+		},
+	}
+
+	if err := ctrl.SetControllerReference(s, draft, r.Scheme); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if err := r.Create(ctx, draft); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if err := r.unblockBridge(ctx, s, MautrixSignalBlockedCondition); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
+
+func (r *BridgeAutopilotReconciler) isConfigMapMissing(ctx context.Context, name, namespace string) (bool, error) {
+	return r.isResourceMissing(ctx, &corev1.ConfigMap{}, name, namespace)
+}
+
+func (r *BridgeAutopilotReconciler) isPVCMissing(ctx context.Context, name, namespace string) (bool, error) {
+	return r.isResourceMissing(ctx, &corev1.PersistentVolumeClaim{}, name, namespace)
+}
+
+// isResourceMissing reports whether the given object, identified by name
+// and namespace, cannot be found.
+func (r *BridgeAutopilotReconciler) isResourceMissing(ctx context.Context, obj client.Object, name, namespace string) (bool, error) {
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, obj)
+	if err == nil {
+		return false, nil
+	}
+	if k8serrors.IsNotFound(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// blockBridge records why an auto-provisioned bridge can't yet be
+// created, by setting conditionType on the owning Synapse. conditionType
+// is per-bridge so that one bridge's block doesn't shadow the other's.
+func (r *BridgeAutopilotReconciler) blockBridge(ctx context.Context, s *synapsev1alpha1.Synapse, conditionType, reason string) (*ctrl.Result, error) {
+	meta.SetStatusCondition(&s.Status.Conditions, metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionTrue,
+		Reason:  "MissingDependency",
+		Message: reason,
+	})
+
+	if err := utils.UpdateSynapseStatus(ctx, r.Client, s); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.Requeue()
+}
+
+// unblockBridge clears conditionType once a bridge is already provisioned
+// or has just been created, so a stale "missing dependency" message
+// doesn't linger after the dependency resolves.
+func (r *BridgeAutopilotReconciler) unblockBridge(ctx context.Context, s *synapsev1alpha1.Synapse, conditionType string) error {
+	changed := meta.SetStatusCondition(&s.Status.Conditions, metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionFalse,
+		Reason:  "DependenciesSatisfied",
+		Message: "all required bindings are present",
+	})
+	if !changed {
+		return nil
+	}
+	return utils.UpdateSynapseStatus(ctx, r.Client, s)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BridgeAutopilotReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&synapsev1alpha1.Synapse{}).
+		Complete(r)
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mautrixsignal
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/opdev/subreconciler"
+	synapsev1alpha1 "github.com/opdev/synapse-operator/apis/synapse/v1alpha1"
+)
+
+// newSignaldPVCName returns the name the "signald" VolumeClaimTemplate
+// produces for the StatefulSet's sole (ordinal 0) replica, which no
+// longer matches the PVC name the old signald Deployment used
+// (GetSignaldResourceName(ms)).
+func newSignaldPVCName(resourceName string) string {
+	return fmt.Sprintf("signald-%s-0", resourceName)
+}
+
+// migrationTargetAnnotation is set on a PersistentVolume being carried
+// over from the old signald Deployment's PVC, recording the PVC name it's
+// being rebound under. The old PVC is deleted as part of that rebind, so
+// this annotation - not the old PVC's presence - is what migrateSignaldStorage
+// checks to tell "migration already in flight" apart from "fresh install".
+const migrationTargetAnnotation = "synapse.opdev.io/migrate-to-pvc"
+
+// migrateSignaldStorage is a function of type FnWithRequest, called from
+// reconcileSignaldStatefulSet ahead of reconciling the StatefulSet itself.
+//
+// Converting signald from a Deployment to a StatefulSet changes its PVC
+// name from GetSignaldResourceName(ms) to
+// newSignaldPVCName(GetSignaldResourceName(ms)), which
+// would otherwise silently orphan the PVC holding existing Signal
+// device-linking state and leave the old Deployment running alongside the
+// new StatefulSet. This deletes the stale Deployment and rebinds the
+// existing PersistentVolume under the name the StatefulSet expects, so
+// reconcileSignaldStatefulSet's VolumeClaimTemplate adopts it instead of
+// provisioning an empty one.
+func (r *MautrixSignalReconciler) migrateSignaldStorage(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	ms := &synapsev1alpha1.MautrixSignal{}
+	if r, err := r.getLatestMautrixSignal(ctx, req, ms); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	resourceName := GetSignaldResourceName(*ms)
+
+	oldDeployment := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: resourceName, Namespace: ms.Namespace}, oldDeployment)
+	if err == nil {
+		if err := r.Delete(ctx, oldDeployment); err != nil && !k8serrors.IsNotFound(err) {
+			return subreconciler.RequeueWithError(err)
+		}
+	} else if !k8serrors.IsNotFound(err) {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	newPVCName := newSignaldPVCName(resourceName)
+	newPVC := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(ctx, types.NamespacedName{Name: newPVCName, Namespace: ms.Namespace}, newPVC); err == nil {
+		// Already migrated.
+		return subreconciler.ContinueReconciling()
+	} else if !k8serrors.IsNotFound(err) {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	pv, err := r.findMigratingSignaldPV(ctx, newPVCName)
+	if err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if pv == nil {
+		oldPVC := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(ctx, types.NamespacedName{Name: resourceName, Namespace: ms.Namespace}, oldPVC); err != nil {
+			if k8serrors.IsNotFound(err) {
+				// Fresh install; there's nothing to migrate.
+				return subreconciler.ContinueReconciling()
+			}
+			return subreconciler.RequeueWithError(err)
+		}
+
+		pv = &corev1.PersistentVolume{}
+		if err := r.Get(ctx, types.NamespacedName{Name: oldPVC.Spec.VolumeName}, pv); err != nil {
+			return subreconciler.RequeueWithError(err)
+		}
+
+		// Retain the underlying volume across the claim swap below, and
+		// mark it with the PVC name it's being carried over to. The old
+		// PVC is deleted right after, so this annotation - not the old
+		// PVC's presence - is what lets a retry tell "migration already
+		// in flight" apart from "fresh install" once deletion completes.
+		if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain || pv.Annotations[migrationTargetAnnotation] != newPVCName {
+			pv.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+			if pv.Annotations == nil {
+				pv.Annotations = map[string]string{}
+			}
+			pv.Annotations[migrationTargetAnnotation] = newPVCName
+			if err := r.Update(ctx, pv); err != nil {
+				return subreconciler.RequeueWithError(err)
+			}
+		}
+
+		if err := r.Delete(ctx, oldPVC); err != nil && !k8serrors.IsNotFound(err) {
+			return subreconciler.RequeueWithError(err)
+		}
+
+		return subreconciler.Requeue()
+	}
+
+	// Wait for the old PVC to actually go away before rebinding the PV
+	// under the new name, otherwise Create below races the old claim's
+	// finalizer-driven teardown.
+	if err := r.Get(ctx, types.NamespacedName{Name: resourceName, Namespace: ms.Namespace}, &corev1.PersistentVolumeClaim{}); err == nil {
+		return subreconciler.Requeue()
+	} else if !k8serrors.IsNotFound(err) {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if pv.Spec.ClaimRef != nil {
+		pv.Spec.ClaimRef = nil
+		if err := r.Update(ctx, pv); err != nil {
+			return subreconciler.RequeueWithError(err)
+		}
+	}
+
+	migratedPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      newPVCName,
+			Namespace: ms.Namespace,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: pv.Spec.AccessModes,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: pv.Spec.Capacity[corev1.ResourceStorage],
+				},
+			},
+			VolumeName: pv.Name,
+		},
+	}
+
+	if err := ctrl.SetControllerReference(ms, migratedPVC, r.Scheme); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if err := r.Create(ctx, migratedPVC); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
+
+// findMigratingSignaldPV looks for a PersistentVolume previously marked by
+// migrateSignaldStorage as being carried over to newPVCName. Unlike the
+// old PVC, which migrateSignaldStorage deletes as part of the rebind, the PV and
+// its annotation persist across the retry that deletion triggers.
+func (r *MautrixSignalReconciler) findMigratingSignaldPV(ctx context.Context, newPVCName string) (*corev1.PersistentVolume, error) {
+	var pvs corev1.PersistentVolumeList
+	if err := r.List(ctx, &pvs); err != nil {
+		return nil, err
+	}
+
+	for i := range pvs.Items {
+		if pvs.Items[i].Annotations[migrationTargetAnnotation] == newPVCName {
+			return &pvs.Items[i], nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mautrixsignal
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/opdev/subreconciler"
+	synapsev1alpha1 "github.com/opdev/synapse-operator/apis/synapse/v1alpha1"
+	"github.com/opdev/synapse-operator/helpers/reconcile"
+)
+
+// defaultSignaldImage is used when Spec.Signald.Image is left empty.
+const defaultSignaldImage = "docker.io/signald/signald:0.23.0"
+
+// defaultSignaldStorageSize is used when Spec.Signald.StorageSize is left
+// empty.
+const defaultSignaldStorageSize = "1Gi"
+
+// signaldSocketPath is where signald exposes its unix socket, used by both
+// the readiness and liveness probes.
+const signaldSocketPath = "/signald/signald.sock"
+
+// terminationGracePeriodSeconds gives signald time to flush its Signal
+// protocol state to disk before being killed.
+const terminationGracePeriodSeconds = 30
+
+// labelsForSignald returns the labels for selecting the resources
+// belonging to the given mautrixsignal CR name.
+func labelsForSignald(name string) map[string]string {
+	return map[string]string{"app": "signald", "mautrixsignal_cr": name}
+}
+
+// reconcileSignaldStatefulSet is a function of type FnWithRequest, to be
+// called in the main reconciliation loop.
+//
+// It reconciles the StatefulSet for signald to its desired state. signald
+// holds Signal protocol state on disk and can corrupt it on an ungraceful
+// restart, so it's run as a StatefulSet with a VolumeClaimTemplate rather
+// than a Deployment, tying the PVC's lifecycle to the pod identity.
+func (r *MautrixSignalReconciler) reconcileSignaldStatefulSet(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	ms := &synapsev1alpha1.MautrixSignal{}
+	if r, err := r.getLatestMautrixSignal(ctx, req, ms); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	if r, err := r.migrateSignaldStorage(ctx, req); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	objectMetaSignald := reconcile.SetObjectMeta(GetSignaldResourceName(*ms), ms.Namespace, map[string]string{})
+
+	desiredStatefulSet, err := r.statefulSetForSignald(ms, objectMetaSignald)
+	if err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if err := reconcile.ReconcileResource(
+		ctx,
+		r.Client,
+		desiredStatefulSet,
+		&appsv1.StatefulSet{},
+	); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
+
+// statefulSetForSignald returns a signald StatefulSet object
+func (r *MautrixSignalReconciler) statefulSetForSignald(ms *synapsev1alpha1.MautrixSignal, objectMeta metav1.ObjectMeta) (*appsv1.StatefulSet, error) {
+	ls := labelsForSignald(ms.Name)
+	replicas := int32(1)
+	gracePeriod := int64(terminationGracePeriodSeconds)
+
+	image := ms.Spec.Signald.Image
+	if image == "" {
+		image = defaultSignaldImage
+	}
+
+	storageSize := ms.Spec.Signald.StorageSize
+	if storageSize == "" {
+		storageSize = defaultSignaldStorageSize
+	}
+
+	readinessProbeCommand := []string{"test", "-S", signaldSocketPath}
+
+	// Liveness needs to catch a signald that is hung but has left the
+	// socket file on disk, which a bare "test -S" would never detect.
+	// Sending a "version" request and checking for a reply confirms the
+	// JSON-RPC server behind the socket is actually responding. Fall back
+	// to the socket-existence check when no "nc" is on the PATH, so a
+	// missing tool doesn't turn into a permanent CrashLoopBackOff. An "nc"
+	// that is present but lacks UNIX-socket support is not detected, and
+	// the probe then fails.
+	livenessProbeCommand := []string{
+		"sh", "-c",
+		fmt.Sprintf(
+			`if command -v nc >/dev/null 2>&1; then echo '{"type":"version"}' | timeout 5 nc -U %s | grep -q type; else test -S %s; fi`,
+			signaldSocketPath, signaldSocketPath,
+		),
+	}
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: objectMeta,
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: objectMeta.Name,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: ls,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: ls,
+				},
+				Spec: corev1.PodSpec{
+					TerminationGracePeriodSeconds: &gracePeriod,
+					Containers: []corev1.Container{{
+						Image:     image,
+						Name:      "signald",
+						Resources: ms.Spec.Signald.Resources,
+						VolumeMounts: []corev1.VolumeMount{{
+							Name:      "signald",
+							MountPath: "/signald",
+						}},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								Exec: &corev1.ExecAction{Command: readinessProbeCommand},
+							},
+							InitialDelaySeconds: 5,
+							PeriodSeconds:       10,
+						},
+						LivenessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								Exec: &corev1.ExecAction{Command: livenessProbeCommand},
+							},
+							InitialDelaySeconds: 15,
+							PeriodSeconds:       20,
+						},
+						Lifecycle: &corev1.Lifecycle{
+							PreStop: &corev1.LifecycleHandler{
+								Exec: &corev1.ExecAction{
+									Command: []string{
+										"/bin/sh", "-c",
+										fmt.Sprintf("kill -TERM 1 && sleep %d", terminationGracePeriodSeconds-5),
+									},
+								},
+							},
+						},
+					}},
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "signald",
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceStorage: resource.MustParse(storageSize),
+						},
+					},
+				},
+			}},
+		},
+	}
+	// Set MautrixSignal instance as the owner and controller
+	if err := ctrl.SetControllerReference(ms, sts, r.Scheme); err != nil {
+		return &appsv1.StatefulSet{}, err
+	}
+	return sts, nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package synapse
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	subreconciler "github.com/opdev/subreconciler"
+	synapsev1alpha1 "github.com/opdev/synapse-operator/apis/synapse/v1alpha1"
+	"github.com/opdev/synapse-operator/helpers/reconcile"
+	"github.com/opdev/synapse-operator/helpers/tailscale"
+	"github.com/opdev/synapse-operator/helpers/tls"
+)
+
+// containerNameForSynapse is the name of the main Synapse container in
+// the Deployment's Pod template.
+const containerNameForSynapse = "synapse"
+
+// reconcileSynapseDeployment is a function of type FnWithRequest, to be
+// called in the main reconciliation loop.
+//
+// It reconciles the Synapse Deployment to its desired state, mutating the
+// Pod template with whatever exposure-mode or TLS sidecar/volume each
+// enabled subsystem requires.
+func (r *SynapseReconciler) reconcileSynapseDeployment(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	s := &synapsev1alpha1.Synapse{}
+	if r, err := r.getLatestSynapse(ctx, req, s); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	objectMetaForSynapse := reconcile.SetObjectMeta(s.Name, s.Namespace, map[string]string{})
+
+	desiredDeployment, err := r.deploymentForSynapse(s, objectMetaForSynapse)
+	if err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if err := reconcile.ReconcileResource(
+		ctx,
+		r.Client,
+		desiredDeployment,
+		&appsv1.Deployment{},
+	); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
+
+// deploymentForSynapse returns a synapse Deployment object
+func (r *SynapseReconciler) deploymentForSynapse(s *synapsev1alpha1.Synapse, objectMeta metav1.ObjectMeta) (*appsv1.Deployment, error) {
+	labels := labelsForSynapse(s.Name)
+	replicas := int32(1)
+
+	synapseContainer := corev1.Container{
+		Name:  containerNameForSynapse,
+		Image: s.Spec.Image,
+		Ports: []corev1.ContainerPort{{
+			Name:          "synapse-unsecure",
+			ContainerPort: 8008,
+		}},
+	}
+
+	podSpec := corev1.PodSpec{
+		Containers: []corev1.Container{synapseContainer},
+	}
+
+	// When the Synapse instance is exposed over a Tailnet, the tsnet
+	// sidecar needs to run alongside the main container and mount the
+	// auth-key Secret that lets it join the tailnet.
+	if isTailscaleExposureEnabled(s) {
+		podSpec.Containers = append(
+			podSpec.Containers,
+			tailscale.SidecarContainer(s.Spec.Exposure.Tailscale.Image, s.Name),
+		)
+		podSpec.Volumes = append(podSpec.Volumes, tailscale.AuthKeyVolume(s.Name))
+	}
+
+	if isTLSEnabled(s) {
+		mainContainer := &podSpec.Containers[0]
+		mainContainer.Ports = append(mainContainer.Ports, corev1.ContainerPort{
+			Name:          "synapse-https",
+			ContainerPort: 8448,
+		})
+
+		// Only mount the cert-manager Secret once reconcileTLSStatus has
+		// confirmed the Certificate is Ready. Mounting it eagerly would
+		// reference a Secret that doesn't exist yet and leave the Pod
+		// stuck in FailedMount until cert-manager catches up.
+		if s.Status.CertificateReady {
+			mainContainer.VolumeMounts = append(mainContainer.VolumeMounts, tls.VolumeMount())
+			mainContainer.Env = append(mainContainer.Env,
+				corev1.EnvVar{Name: "SYNAPSE_TLS_CERT_PATH", Value: tls.CertPath()},
+				corev1.EnvVar{Name: "SYNAPSE_TLS_KEY_PATH", Value: tls.KeyPath()},
+			)
+			podSpec.Volumes = append(podSpec.Volumes, tls.Volume(s.Spec.TLS.SecretName))
+		}
+	}
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: objectMeta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+
+	// Set Synapse instance as the owner and controller
+	if err := ctrl.SetControllerReference(s, deployment, r.Scheme); err != nil {
+		return &appsv1.Deployment{}, err
+	}
+	return deployment, nil
+}
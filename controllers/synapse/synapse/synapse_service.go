@@ -72,6 +72,29 @@ func (r *SynapseReconciler) serviceForSynapse(s *synapsev1alpha1.Synapse, object
 			Type:     corev1.ServiceTypeClusterIP,
 		},
 	}
+
+	// When the Synapse instance is exposed over a Tailnet, the tsnet
+	// sidecar terminates federation/client traffic itself. We still need a
+	// Service for in-cluster traffic (e.g. bridges talking to Synapse
+	// directly) but it must be headless, and we must not create a
+	// LoadBalancer Service on top of it.
+	if isTailscaleExposureEnabled(s) {
+		service.Spec.ClusterIP = corev1.ClusterIPNone
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Name:       "synapse-federation",
+			Protocol:   corev1.ProtocolTCP,
+			Port:       8448,
+			TargetPort: intstr.FromInt(8448),
+		})
+	} else if isTLSEnabled(s) {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Name:       "synapse-https",
+			Protocol:   corev1.ProtocolTCP,
+			Port:       8448,
+			TargetPort: intstr.FromInt(8448),
+		})
+	}
+
 	// Set Synapse instance as the owner and controller
 	if err := ctrl.SetControllerReference(s, service, r.Scheme); err != nil {
 		return &corev1.Service{}, err
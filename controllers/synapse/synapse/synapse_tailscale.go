@@ -0,0 +1,115 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package synapse
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	subreconciler "github.com/opdev/subreconciler"
+	synapsev1alpha1 "github.com/opdev/synapse-operator/apis/synapse/v1alpha1"
+	"github.com/opdev/synapse-operator/helpers/tailscale"
+	"github.com/opdev/synapse-operator/helpers/utils"
+)
+
+// isTailscaleExposureEnabled returns true if the user asked for the
+// Synapse instance to be exposed over a Tailnet rather than a regular
+// ClusterIP/LoadBalancer Service.
+func isTailscaleExposureEnabled(s *synapsev1alpha1.Synapse) bool {
+	return s.Spec.Exposure.Mode == "Tailscale"
+}
+
+// reconcileTailscaleAuthKeySecret is a function of type FnWithRequest, to
+// be called in the main reconciliation loop.
+//
+// It validates that the Secret holding the Tailscale auth key, referenced
+// by the user, exists before the tsnet sidecar is allowed to start.
+func (r *SynapseReconciler) reconcileTailscaleAuthKeySecret(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	s := &synapsev1alpha1.Synapse{}
+	if r, err := r.getLatestSynapse(ctx, req, s); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	if !isTailscaleExposureEnabled(s) {
+		return subreconciler.ContinueReconciling()
+	}
+
+	authKeySecret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      tailscale.AuthKeySecretName(s.Name),
+		Namespace: s.Namespace,
+	}, authKeySecret); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return subreconciler.RequeueWithError(
+				fmt.Errorf("tailscale auth key secret %s not found", tailscale.AuthKeySecretName(s.Name)),
+			)
+		}
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
+
+// reconcileTailscaleStatus is a function of type FnWithRequest, to be
+// called in the main reconciliation loop.
+//
+// Once the tsnet sidecar has joined the tailnet and persisted its state,
+// it reflects the advertised tailnet hostname in Synapse.Status.HomeserverURL.
+func (r *SynapseReconciler) reconcileTailscaleStatus(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	s := &synapsev1alpha1.Synapse{}
+	if r, err := r.getLatestSynapse(ctx, req, s); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	if !isTailscaleExposureEnabled(s) {
+		return subreconciler.ContinueReconciling()
+	}
+
+	stateSecret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      tailscale.StateSecretName(s.Name),
+		Namespace: s.Namespace,
+	}, stateSecret); err != nil {
+		if k8serrors.IsNotFound(err) {
+			// The sidecar hasn't joined the tailnet and persisted its
+			// state yet. Requeue and check again later, rather than
+			// erroring out.
+			return subreconciler.Requeue()
+		}
+		return subreconciler.RequeueWithError(err)
+	}
+
+	fqdn, ok := tailscale.FQDNFromState(stateSecret)
+	if !ok {
+		// The sidecar has persisted state but hasn't written its
+		// MagicDNS FQDN yet. Requeue and check again later.
+		return subreconciler.Requeue()
+	}
+
+	s.Status.HomeserverURL = fmt.Sprintf("https://%s", fqdn)
+
+	if err := utils.UpdateSynapseStatus(ctx, r.Client, s); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package synapse
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	subreconciler "github.com/opdev/subreconciler"
+	synapsev1alpha1 "github.com/opdev/synapse-operator/apis/synapse/v1alpha1"
+	"github.com/opdev/synapse-operator/helpers/reconcile"
+	"github.com/opdev/synapse-operator/helpers/tls"
+	"github.com/opdev/synapse-operator/helpers/utils"
+)
+
+// isTLSEnabled returns true if the user asked the operator to provision
+// and terminate TLS on the Synapse Service.
+func isTLSEnabled(s *synapsev1alpha1.Synapse) bool {
+	return s.Spec.TLS.Enabled
+}
+
+func certificateName(s *synapsev1alpha1.Synapse) string {
+	return s.Name + "-tls"
+}
+
+// serverNameFor returns the domain the Certificate should be issued for:
+// the vanity DomainMapping when the user set one, otherwise the Synapse
+// instance's in-cluster name.
+func serverNameFor(s *synapsev1alpha1.Synapse) string {
+	if s.Spec.TLS.DomainMapping != "" {
+		return s.Spec.TLS.DomainMapping
+	}
+	return s.Name
+}
+
+// reconcileSynapseCertificate is a function of type FnWithRequest, to be
+// called in the main reconciliation loop.
+//
+// It reconciles the cert-manager Certificate requesting a certificate for
+// the domain serverNameFor returns (Spec.TLS.DomainMapping, or else the
+// Synapse object's name), storing the resulting key pair in
+// Spec.TLS.SecretName. The server_name configured in homeserver.yaml is
+// not read.
+func (r *SynapseReconciler) reconcileSynapseCertificate(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	s := &synapsev1alpha1.Synapse{}
+	if r, err := r.getLatestSynapse(ctx, req, s); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	if !isTLSEnabled(s) {
+		return subreconciler.ContinueReconciling()
+	}
+
+	desiredCertificate := tls.DesiredCertificate(
+		serverNameFor(s),
+		s.Spec.TLS.Issuer,
+		s.Spec.TLS.SecretName,
+		s.Namespace,
+		certificateName(s),
+	)
+
+	if err := ctrl.SetControllerReference(s, desiredCertificate, r.Scheme); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if err := reconcile.ReconcileResource(
+		ctx,
+		r.Client,
+		desiredCertificate,
+		&unstructured.Unstructured{},
+	); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
+
+// reconcileSynapseDomainMapping is a function of type FnWithRequest, to be
+// called in the main reconciliation loop.
+//
+// When Spec.TLS.DomainMapping is set, it binds the vanity domain to the
+// in-cluster Synapse Service, so that the advertised server_name can
+// differ from the Service's cluster-internal FQDN.
+func (r *SynapseReconciler) reconcileSynapseDomainMapping(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	s := &synapsev1alpha1.Synapse{}
+	if r, err := r.getLatestSynapse(ctx, req, s); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	if !isTLSEnabled(s) || s.Spec.TLS.DomainMapping == "" {
+		return subreconciler.ContinueReconciling()
+	}
+
+	desiredDomainMapping := tls.DesiredDomainMapping(s.Spec.TLS.DomainMapping, s.Name, s.Namespace)
+
+	if err := ctrl.SetControllerReference(s, desiredDomainMapping, r.Scheme); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if err := reconcile.ReconcileResource(
+		ctx,
+		r.Client,
+		desiredDomainMapping,
+		&unstructured.Unstructured{},
+	); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
+
+// reconcileTLSStatus is a function of type FnWithRequest, to be called in
+// the main reconciliation loop.
+//
+// It waits for Spec.TLS.SecretName to be populated by cert-manager, and
+// surfaces the Certificate's Ready condition on Synapse.Status.
+func (r *SynapseReconciler) reconcileTLSStatus(ctx context.Context, req ctrl.Request) (*ctrl.Result, error) {
+	s := &synapsev1alpha1.Synapse{}
+	if r, err := r.getLatestSynapse(ctx, req, s); subreconciler.ShouldHaltOrRequeue(r, err) {
+		return r, err
+	}
+
+	if !isTLSEnabled(s) {
+		return subreconciler.ContinueReconciling()
+	}
+
+	cert := &unstructured.Unstructured{}
+	cert.SetAPIVersion(tls.CertificateGroupVersion)
+	cert.SetKind(tls.CertificateKind)
+	if err := r.Get(ctx, types.NamespacedName{Name: certificateName(s), Namespace: s.Namespace}, cert); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return subreconciler.Requeue()
+		}
+		return subreconciler.RequeueWithError(err)
+	}
+
+	s.Status.CertificateReady = tls.IsReady(cert)
+
+	if err := utils.UpdateSynapseStatus(ctx, r.Client, s); err != nil {
+		return subreconciler.RequeueWithError(err)
+	}
+
+	if !s.Status.CertificateReady {
+		return subreconciler.Requeue()
+	}
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: s.Spec.TLS.SecretName, Namespace: s.Namespace}, secret); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return subreconciler.Requeue()
+		}
+		return subreconciler.RequeueWithError(err)
+	}
+
+	return subreconciler.ContinueReconciling()
+}
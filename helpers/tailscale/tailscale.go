@@ -0,0 +1,125 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tailscale provides the building blocks for exposing a Synapse
+// instance over a Tailnet instead of a ClusterIP/LoadBalancer Service. It
+// mirrors the sidecar pattern used by the Tailscale Kubernetes operator: a
+// tsnet node runs alongside the main container and joins the tailnet using
+// state persisted in a Kubernetes Secret.
+package tailscale
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultImage is used when Spec.Exposure.Tailscale.Image is left empty.
+	DefaultImage = "ghcr.io/tailscale/tailscale:latest"
+
+	// ContainerName is the name of the sidecar container injected into the
+	// Synapse Deployment.
+	ContainerName = "tailscale"
+
+	// EnvHostname is the environment variable tsnet reads to advertise a
+	// stable hostname on the tailnet.
+	EnvHostname = "TS_HOSTNAME"
+
+	// EnvKubeSecret is the environment variable pointing tsnet's kubestore
+	// backend at the Secret used to persist tailnet state.
+	EnvKubeSecret = "TS_KUBE_SECRET"
+
+	// EnvAuthKeyFile is the environment variable pointing tsnet at the file
+	// holding the Tailscale auth key, mounted from the auth Secret.
+	EnvAuthKeyFile = "TS_AUTHKEY_FILE"
+
+	// AuthKeySecretKey is the key, within the auth Secret, holding the
+	// Tailscale auth key.
+	AuthKeySecretKey = "authkey"
+
+	// FQDNStateKey is the key, within the state Secret, that the sidecar
+	// writes its fully-qualified MagicDNS name to once it has joined the
+	// tailnet. MagicDNS names are <hostname>.<tailnet-name>.ts.net, and
+	// the tailnet-name segment isn't known to the operator, so it can't
+	// be synthesized from the Synapse name alone.
+	FQDNStateKey = "device_fqdn"
+
+	authKeyMountPath = "/var/run/tailscale"
+)
+
+// Hostname returns the hostname the sidecar should advertise on the
+// tailnet for a given Synapse instance.
+func Hostname(synapseName string) string {
+	return synapseName
+}
+
+// FQDNFromState reads the tsnet sidecar's advertised MagicDNS FQDN out of
+// the state Secret. It returns false until the sidecar has joined the
+// tailnet and written FQDNStateKey.
+func FQDNFromState(stateSecret *corev1.Secret) (string, bool) {
+	fqdn, ok := stateSecret.Data[FQDNStateKey]
+	if !ok || len(fqdn) == 0 {
+		return "", false
+	}
+	return string(fqdn), true
+}
+
+// StateSecretName returns the name of the Secret used by tsnet's kubestore
+// backend to persist tailnet state for a given Synapse instance.
+func StateSecretName(synapseName string) string {
+	return synapseName + "-tailscale-state"
+}
+
+// AuthKeySecretName returns the name of the Secret expected to hold the
+// Tailscale auth key for a given Synapse instance.
+func AuthKeySecretName(synapseName string) string {
+	return synapseName + "-tailscale-authkey"
+}
+
+// SidecarContainer returns the tsnet sidecar container to inject into the
+// Synapse Deployment so that it joins the operator's tailnet.
+func SidecarContainer(image, synapseName string) corev1.Container {
+	if image == "" {
+		image = DefaultImage
+	}
+
+	return corev1.Container{
+		Name:  ContainerName,
+		Image: image,
+		Env: []corev1.EnvVar{
+			{Name: EnvHostname, Value: Hostname(synapseName)},
+			{Name: EnvKubeSecret, Value: StateSecretName(synapseName)},
+			{Name: EnvAuthKeyFile, Value: authKeyMountPath + "/" + AuthKeySecretKey},
+		},
+		VolumeMounts: []corev1.VolumeMount{{
+			Name:      "tailscale-authkey",
+			MountPath: authKeyMountPath,
+			ReadOnly:  true,
+		}},
+	}
+}
+
+// AuthKeyVolume returns the Volume, sourced from the auth key Secret, that
+// SidecarContainer's VolumeMount expects to find on the Pod.
+func AuthKeyVolume(synapseName string) corev1.Volume {
+	return corev1.Volume{
+		Name: "tailscale-authkey",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: AuthKeySecretName(synapseName),
+			},
+		},
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tls builds the cert-manager Certificate and Knative-style
+// DomainMapping objects used to terminate TLS on the Synapse Service,
+// without requiring the cert-manager or Knative Go clients as a
+// dependency. Both CRs are assembled as unstructured.Unstructured, since
+// the operator only ever needs to set a handful of fields and read back
+// their Ready condition.
+package tls
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// MountPath is where the TLS Secret is mounted into the Synapse container
+// once cert-manager has issued a certificate.
+const MountPath = "/data/tls"
+
+// certFileName and keyFileName are the keys cert-manager writes the
+// issued certificate and private key under in the TLS Secret.
+const (
+	certFileName = "tls.crt"
+	keyFileName  = "tls.key"
+)
+
+// CertPath returns the path, under MountPath, homeserver.yaml's
+// tls_certificate_path should point at.
+func CertPath() string {
+	return MountPath + "/" + certFileName
+}
+
+// KeyPath returns the path, under MountPath, homeserver.yaml's
+// tls_private_key_path should point at.
+func KeyPath() string {
+	return MountPath + "/" + keyFileName
+}
+
+const (
+	// CertificateGroupVersion is the apiVersion of the cert-manager
+	// Certificate resource reconciled for the Synapse server_name.
+	CertificateGroupVersion = "cert-manager.io/v1"
+	// CertificateKind is the kind of the cert-manager Certificate resource.
+	CertificateKind = "Certificate"
+
+	// DomainMappingGroupVersion is the apiVersion of the Knative-style
+	// DomainMapping resource used to bind a vanity domain to the Synapse
+	// Service.
+	DomainMappingGroupVersion = "serving.knative.dev/v1beta1"
+	// DomainMappingKind is the kind of the DomainMapping resource.
+	DomainMappingKind = "DomainMapping"
+
+	// readyConditionType is the condition type both cert-manager
+	// Certificates and Knative DomainMappings use to report readiness.
+	readyConditionType = "Ready"
+)
+
+// DesiredCertificate returns the cert-manager Certificate requesting a
+// certificate for serverName, issued by issuerName and stored in
+// secretName.
+func DesiredCertificate(serverName, issuerName, secretName, namespace, name string) *unstructured.Unstructured {
+	cert := &unstructured.Unstructured{}
+	cert.SetAPIVersion(CertificateGroupVersion)
+	cert.SetKind(CertificateKind)
+	cert.SetName(name)
+	cert.SetNamespace(namespace)
+
+	_ = unstructured.SetNestedStringSlice(cert.Object, []string{serverName}, "spec", "dnsNames")
+	_ = unstructured.SetNestedField(cert.Object, secretName, "spec", "secretName")
+	_ = unstructured.SetNestedField(cert.Object, issuerName, "spec", "issuerRef", "name")
+
+	return cert
+}
+
+// serviceGroupVersion and serviceKind identify the Kubernetes Service
+// DesiredDomainMapping's spec.ref points at.
+const (
+	serviceGroupVersion = "v1"
+	serviceKind         = "Service"
+)
+
+// DesiredDomainMapping returns the Knative-style DomainMapping binding the
+// vanity domain to the given Kubernetes Service, so that the advertised
+// server_name can differ from the cluster-internal Service FQDN.
+func DesiredDomainMapping(domain, serviceName, namespace string) *unstructured.Unstructured {
+	dm := &unstructured.Unstructured{}
+	dm.SetAPIVersion(DomainMappingGroupVersion)
+	dm.SetKind(DomainMappingKind)
+	dm.SetName(domain)
+	dm.SetNamespace(namespace)
+
+	_ = unstructured.SetNestedField(dm.Object, serviceName, "spec", "ref", "name")
+	_ = unstructured.SetNestedField(dm.Object, serviceKind, "spec", "ref", "kind")
+	_ = unstructured.SetNestedField(dm.Object, serviceGroupVersion, "spec", "ref", "apiVersion")
+	_ = unstructured.SetNestedField(dm.Object, namespace, "spec", "ref", "namespace")
+
+	return dm
+}
+
+// Volume returns the Volume, sourced from the Secret cert-manager writes
+// the issued certificate to, to be mounted at MountPath.
+func Volume(secretName string) corev1.Volume {
+	return corev1.Volume{
+		Name: "tls",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secretName,
+			},
+		},
+	}
+}
+
+// VolumeMount returns the VolumeMount pairing with Volume, to be added to
+// the Synapse container so homeserver.yaml's tls_certificate_path and
+// tls_private_key_path can point at MountPath.
+func VolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      "tls",
+		MountPath: MountPath,
+		ReadOnly:  true,
+	}
+}
+
+// IsReady inspects the status.conditions of a cert-manager Certificate or
+// Knative DomainMapping and reports whether its Ready condition is True.
+func IsReady(obj *unstructured.Unstructured) bool {
+	conditions, found, err := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	if err != nil || !found {
+		return false
+	}
+
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == readyConditionType && condition["status"] == "True" {
+			return true
+		}
+	}
+
+	return false
+}